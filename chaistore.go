@@ -1,66 +1,303 @@
 package chaistore
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/chaisql/chai"
 )
 
-// ChaiStore represents the session store.
+// defaultTombstoneTTL is how long a session_tombstones row is kept around
+// before the cleanup goroutine GCs it, unless overridden with
+// WithTombstoneTTL. It mirrors Consul's default KV tombstone TTL: long
+// enough that a Changes caller which polls periodically won't miss a
+// delete, short enough that the table doesn't grow unbounded.
+const defaultTombstoneTTL = 72 * time.Hour
+
+// defaultCleanupBatchSize and defaultCleanupBatchDelay bound how much of the
+// sessions/session_tombstones tables the cleanup goroutine touches per
+// iteration, unless overridden with WithCleanupBatchSize and
+// WithCleanupBatchDelay. They keep a single cleanup pass from holding a
+// write lock long enough to stall other traffic once those tables are
+// large.
+const (
+	defaultCleanupBatchSize  = 500
+	defaultCleanupBatchDelay = 10 * time.Millisecond
+)
+
+// ChaiStore represents the session store. It implements scs.Store,
+// scs.IterableStore, and their context-aware counterparts scs.CtxStore and
+// scs.IterableCtxStore.
+//
+// In addition to the sessions table, ChaiStore expects the following schema
+// to exist:
+//
+//	CREATE TABLE session_tombstones (
+//		namespace  TEXT      NOT NULL DEFAULT '',
+//		token      TEXT      NOT NULL,
+//		deleted_at TIMESTAMP NOT NULL,
+//		version    INTEGER   NOT NULL,
+//		PRIMARY KEY (namespace, token)
+//	);
+//	CREATE SEQUENCE sessions_version_seq;
+//
+// and the sessions table must carry an additional version column and be
+// keyed by namespace as well as token. chai's ALTER TABLE only supports
+// RENAME and ADD COLUMN, not changing a table's primary key, so an existing
+// sessions table (PRIMARY KEY (token)) can't be upgraded in place: adding the
+// namespace column without also widening the primary key would leave a
+// single shared sessions table, where two namespaces committing the same
+// token value collide via ON CONFLICT REPLACE instead of being isolated.
+// Migrate by recreating the table and copying the data across:
+//
+//	CREATE TABLE sessions_new (
+//		namespace TEXT      NOT NULL DEFAULT '',
+//		token     TEXT      NOT NULL,
+//		data      BLOB      NOT NULL,
+//		expiry    TIMESTAMP NOT NULL,
+//		version   INTEGER   NOT NULL DEFAULT 0,
+//		PRIMARY KEY (namespace, token)
+//	);
+//	INSERT INTO sessions_new (token, data, expiry) SELECT token, data, expiry FROM sessions;
+//	DROP TABLE sessions;
+//	ALTER TABLE sessions_new RENAME TO sessions;
+//
+// Every row copied this way lands in the default namespace (namespace ”),
+// matching the existing ChaiStore returned by New and NewWithCleanupInterval.
+//
+// The version column is bumped from sessions_version_seq on every Commit and
+// Delete, giving callers of Changes a monotonically increasing index they
+// can tail without missing deletes.
+//
+// By default, session data is stored as-is. Pass WithCodec to compress or
+// encrypt it at rest; see GzipCodec, ZstdCodec, and AESGCMCodec.
+//
+// Every ChaiStore instance is scoped to a single namespace, so several
+// instances can share one *chai.DB (and so one chai file) without their
+// tokens colliding; see NewNamespaced and NewNamespacedWithCleanupInterval.
 type ChaiStore struct {
-	db          *chai.DB
-	stopCleanup chan bool
+	db                  *chai.DB
+	namespace           string
+	stopCleanup         chan bool
+	operationTimeout    time.Duration
+	tombstoneTTL        time.Duration
+	cleanupErrorHandler func(error)
+	cleanupBatchSize    int
+	cleanupBatchDelay   time.Duration
+	cleanupMaxDuration  time.Duration
+	cleanupJitter       time.Duration
+	codec               Codec
+
+	statsMu sync.Mutex
+	stats   CleanupStats
+}
+
+// CleanupStats reports what the background cleanup goroutine has done so
+// far, as returned by Stats.
+type CleanupStats struct {
+	// RowsDeleted is the total number of expired sessions and GC'd
+	// tombstones removed across every cleanup pass.
+	RowsDeleted uint64
+	// Batches is the total number of delete batches executed, each
+	// bounded by CleanupBatchSize.
+	Batches uint64
+	// LastError is the error returned by the most recent cleanup pass,
+	// or nil if it succeeded.
+	LastError error
+	// LastDuration is how long the most recent cleanup pass took.
+	LastDuration time.Duration
+}
+
+// New returns a new ChaiStore instance in the default namespace, with a
+// background cleanup goroutine that runs every 5 minutes to remove expired
+// session data.
+func New(db *chai.DB, opts ...Option) *ChaiStore {
+	return NewNamespacedWithCleanupInterval(db, "", 5*time.Minute, opts...)
+}
+
+// NewWithCleanupInterval returns a new ChaiStore instance in the default
+// namespace. The cleanupInterval parameter controls how frequently expired
+// session data is removed by the background cleanup goroutine. Setting it
+// to 0 prevents the cleanup goroutine from running (i.e. expired sessions
+// will not be removed).
+//
+// opts can be used to customize the store, for example to bound every
+// operation with WithOperationTimeout, to replace the default cleanup
+// error logging with WithCleanupErrorHandler, to change how long
+// tombstones are retained with WithTombstoneTTL, to tune how the cleanup
+// goroutine batches its deletes with WithCleanupBatchSize,
+// WithCleanupBatchDelay, WithCleanupMaxDuration, and WithCleanupJitter, or
+// to compress or encrypt session data at rest with WithCodec.
+func NewWithCleanupInterval(db *chai.DB, cleanupInterval time.Duration, opts ...Option) *ChaiStore {
+	return NewNamespacedWithCleanupInterval(db, "", cleanupInterval, opts...)
 }
 
-// New returns a new ChaiStore instance, with a background cleanup goroutine
-// that runs every 5 minutes to remove expired session data.
-func New(db *chai.DB) *ChaiStore {
-	return NewWithCleanupInterval(db, 5*time.Minute)
+// NewNamespaced returns a new ChaiStore instance scoped to namespace, with a
+// background cleanup goroutine that runs every 5 minutes to remove expired
+// session data. Several ChaiStore instances, each with its own namespace,
+// can share a single *chai.DB: this lets one process host several SCS
+// SessionManagers (an admin session store and a public one, one per tenant,
+// one per A/B test cohort, ...) without opening a separate chai file for
+// each.
+func NewNamespaced(db *chai.DB, namespace string, opts ...Option) *ChaiStore {
+	return NewNamespacedWithCleanupInterval(db, namespace, 5*time.Minute, opts...)
 }
 
-// NewWithCleanupInterval returns a new ChaiStore instance. The cleanupInterval
-// parameter controls how frequently expired session data is removed by the
-// background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
-// from running (i.e. expired sessions will not be removed).
-func NewWithCleanupInterval(db *chai.DB, cleanupInterval time.Duration) *ChaiStore {
-	p := &ChaiStore{db: db}
+// NewNamespacedWithCleanupInterval is like NewNamespaced, but the
+// cleanupInterval parameter controls how frequently expired session data is
+// removed by the background cleanup goroutine. Setting it to 0 prevents the
+// cleanup goroutine from running (i.e. expired sessions will not be
+// removed). Each ChaiStore sharing a *chai.DB runs its own cleanup
+// goroutine, scoped to its own namespace; see WithCleanupJitter to avoid
+// them all running at once.
+//
+// opts can be used to customize the store, for example to bound every
+// operation with WithOperationTimeout, to replace the default cleanup
+// error logging with WithCleanupErrorHandler, to change how long
+// tombstones are retained with WithTombstoneTTL, to tune how the cleanup
+// goroutine batches its deletes with WithCleanupBatchSize,
+// WithCleanupBatchDelay, WithCleanupMaxDuration, and WithCleanupJitter, or
+// to compress or encrypt session data at rest with WithCodec.
+func NewNamespacedWithCleanupInterval(db *chai.DB, namespace string, cleanupInterval time.Duration, opts ...Option) *ChaiStore {
+	p := &ChaiStore{
+		db:                  db,
+		namespace:           namespace,
+		cleanupErrorHandler: func(err error) { log.Println(err) },
+		tombstoneTTL:        defaultTombstoneTTL,
+		cleanupBatchSize:    defaultCleanupBatchSize,
+		cleanupBatchDelay:   defaultCleanupBatchDelay,
+		codec:               IdentityCodec{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
 	if cleanupInterval > 0 {
 		go p.startCleanup(cleanupInterval)
 	}
 	return p
 }
 
+// opCtx derives a context for a single store operation, applying
+// operationTimeout if one was configured via WithOperationTimeout.
+func (p *ChaiStore) opCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.operationTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, p.operationTimeout)
+}
+
 // Find returns the data for a given session token from the ChaiStore instance.
 // If the session token is not found or is expired, the returned exists flag will
 // be set to false.
 func (p *ChaiStore) Find(token string) (b []byte, exists bool, err error) {
-	row, err := p.db.QueryRow("SELECT data FROM sessions WHERE token = ? AND ? < expiry", token, time.Now())
+	return p.FindCtx(context.Background(), token)
+}
+
+// FindCtx is like Find, but the underlying chai query is bound to ctx, so
+// the operation is aborted if ctx is cancelled or its deadline is exceeded
+// before the query completes.
+func (p *ChaiStore) FindCtx(ctx context.Context, token string) (b []byte, exists bool, err error) {
+	ctx, cancel := p.opCtx(ctx)
+	defer cancel()
+	return p.find(p.db.WithContext(ctx), token)
+}
+
+func (p *ChaiStore) find(db *chai.DB, token string) (b []byte, exists bool, err error) {
+	row, err := db.QueryRow("SELECT data FROM sessions WHERE namespace = ? AND token = ? AND ? < expiry", p.namespace, token, time.Now())
 	if chai.IsNotFoundError(err) {
 		return nil, false, nil
 	} else if err != nil {
 		return nil, false, err
 	}
-	return b, true, row.Scan(&b)
+	if err := row.Scan(&b); err != nil {
+		return nil, true, err
+	}
+	b, err = p.codec.Decode(b)
+	return b, true, err
 }
 
 // Commit adds a session token and data to the ChaiStore instance with the
 // given expiry time. If the session token already exists, then the data and expiry
 // time are updated.
 func (p *ChaiStore) Commit(token string, b []byte, expiry time.Time) error {
-	return p.db.Exec("INSERT INTO sessions (token, data, expiry) VALUES (?, ?, ?) ON CONFLICT REPLACE", token, b, expiry.UTC())
+	return p.CommitCtx(context.Background(), token, b, expiry)
+}
+
+// CommitCtx is like Commit, but the underlying chai exec is bound to ctx, so
+// the operation is aborted if ctx is cancelled or its deadline is exceeded
+// before the write completes.
+func (p *ChaiStore) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	ctx, cancel := p.opCtx(ctx)
+	defer cancel()
+	return p.commit(p.db.WithContext(ctx), token, b, expiry)
+}
+
+func (p *ChaiStore) commit(db *chai.DB, token string, b []byte, expiry time.Time) error {
+	b, err := p.codec.Encode(b)
+	if err != nil {
+		return err
+	}
+	return db.Exec(
+		"INSERT INTO sessions (namespace, token, data, expiry, version) VALUES (?, ?, ?, ?, NEXT VALUE FOR sessions_version_seq) ON CONFLICT REPLACE",
+		p.namespace, token, b, expiry.UTC(),
+	)
 }
 
 // Delete removes a session token and corresponding data from the ChaiStore
-// instance.
+// instance. Rather than hard-deleting the row, it replaces it with a
+// tombstone in session_tombstones carrying the next sessions_version_seq
+// value, so that a Changes caller tailing the version index observes the
+// delete instead of the token simply disappearing. Tombstones are GC'd by
+// the background cleanup goroutine once they're older than TombstoneTTL.
 func (p *ChaiStore) Delete(token string) error {
-	return p.db.Exec("DELETE FROM sessions WHERE token = ?", token)
+	return p.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is like Delete, but the underlying chai transaction is bound to
+// ctx, so the operation is aborted if ctx is cancelled or its deadline is
+// exceeded before the delete completes.
+func (p *ChaiStore) DeleteCtx(ctx context.Context, token string) error {
+	ctx, cancel := p.opCtx(ctx)
+	defer cancel()
+	return p.delete(p.db.WithContext(ctx), token)
+}
+
+func (p *ChaiStore) delete(db *chai.DB, token string) error {
+	return db.Update(func(tx *chai.Tx) error {
+		err := tx.Exec("DELETE FROM sessions WHERE namespace = ? AND token = ?", p.namespace, token)
+		if err != nil {
+			return err
+		}
+		return tx.Exec(
+			"INSERT INTO session_tombstones (namespace, token, deleted_at, version) VALUES (?, ?, ?, NEXT VALUE FOR sessions_version_seq) ON CONFLICT REPLACE",
+			p.namespace, token, time.Now().UTC(),
+		)
+	})
 }
 
 // All returns a map containing the token and data for all active (i.e.
 // not expired) sessions in the ChaiStore instance.
 func (p *ChaiStore) All() (map[string][]byte, error) {
-	rows, err := p.db.Query("SELECT token, data FROM sessions WHERE ? < expiry", time.Now())
+	return p.AllCtx(context.Background())
+}
+
+// AllCtx is like All, but the underlying chai query is bound to ctx, so the
+// operation is aborted if ctx is cancelled or its deadline is exceeded before
+// the query completes.
+func (p *ChaiStore) AllCtx(ctx context.Context) (map[string][]byte, error) {
+	ctx, cancel := p.opCtx(ctx)
+	defer cancel()
+	return p.all(p.db.WithContext(ctx))
+}
+
+func (p *ChaiStore) all(db *chai.DB) (map[string][]byte, error) {
+	rows, err := db.Query("SELECT token, data FROM sessions WHERE namespace = ? AND ? < expiry", p.namespace, time.Now())
 	if err != nil {
 		return nil, err
 	}
@@ -79,6 +316,11 @@ func (p *ChaiStore) All() (map[string][]byte, error) {
 			return err
 		}
 
+		data, err = p.codec.Decode(data)
+		if err != nil {
+			return err
+		}
+
 		sessions[token] = data
 		return nil
 	})
@@ -86,23 +328,146 @@ func (p *ChaiStore) All() (map[string][]byte, error) {
 	return sessions, err
 }
 
+// Change describes a single mutation (an upsert from Commit or a tombstone
+// from Delete) observed at or after a given version. Deleted reports
+// whether this Change is a tombstone, in which case Data and Expiry are
+// zero and DeletedAt holds the time the tombstone was written.
+type Change struct {
+	Token     string
+	Data      []byte
+	Expiry    time.Time
+	Deleted   bool
+	DeletedAt time.Time
+	Version   uint64
+}
+
+// Changes returns every session mutation recorded with a version strictly
+// greater than sinceVersion, ordered by version, along with the highest
+// version present in that set (or sinceVersion unchanged if there were no
+// new changes). Callers can pass the returned version back into the next
+// call to Changes to tail the store without missing a Delete, even if the
+// deleted token's row no longer exists: the tombstone in session_tombstones
+// stands in for it until TombstoneTTL expires.
+func (p *ChaiStore) Changes(sinceVersion uint64) ([]Change, uint64, error) {
+	return p.ChangesCtx(context.Background(), sinceVersion)
+}
+
+// ChangesCtx is like Changes, but the underlying chai queries are bound to
+// ctx, so the operation is aborted if ctx is cancelled or its deadline is
+// exceeded before they complete.
+func (p *ChaiStore) ChangesCtx(ctx context.Context, sinceVersion uint64) ([]Change, uint64, error) {
+	ctx, cancel := p.opCtx(ctx)
+	defer cancel()
+	return p.changes(p.db.WithContext(ctx), sinceVersion)
+}
+
+func (p *ChaiStore) changes(db *chai.DB, sinceVersion uint64) ([]Change, uint64, error) {
+	changes := make([]Change, 0)
+	maxVersion := sinceVersion
+
+	upserts, err := db.Query("SELECT token, data, expiry, version FROM sessions WHERE namespace = ? AND version > ?", p.namespace, sinceVersion)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer upserts.Close()
+
+	err = upserts.Iterate(func(row *chai.Row) error {
+		var c Change
+		if err := row.Scan(&c.Token, &c.Data, &c.Expiry, &c.Version); err != nil {
+			return err
+		}
+		c.Data, err = p.codec.Decode(c.Data)
+		if err != nil {
+			return err
+		}
+		if c.Version > maxVersion {
+			maxVersion = c.Version
+		}
+		changes = append(changes, c)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tombstones, err := db.Query("SELECT token, deleted_at, version FROM session_tombstones WHERE namespace = ? AND version > ?", p.namespace, sinceVersion)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tombstones.Close()
+
+	err = tombstones.Iterate(func(row *chai.Row) error {
+		c := Change{Deleted: true}
+		if err := row.Scan(&c.Token, &c.DeletedAt, &c.Version); err != nil {
+			return err
+		}
+		if c.Version > maxVersion {
+			maxVersion = c.Version
+		}
+		changes = append(changes, c)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Version < changes[j].Version })
+
+	return changes, maxVersion, nil
+}
+
 func (p *ChaiStore) startCleanup(interval time.Duration) {
 	p.stopCleanup = make(chan bool)
-	ticker := time.NewTicker(interval)
+	timer := time.NewTimer(p.jitteredInterval(interval))
+	defer timer.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			err := p.deleteExpired()
-			if err != nil {
-				log.Println(err)
-			}
+		case <-timer.C:
+			p.runCleanup()
+			timer.Reset(p.jitteredInterval(interval))
 		case <-p.stopCleanup:
-			ticker.Stop()
 			return
 		}
 	}
 }
 
+// jitteredInterval adds a random delay in [0, cleanupJitter) to interval, so
+// that multiple ChaiStore instances sharing a database, all started around
+// the same time, don't run their cleanup passes in lockstep.
+func (p *ChaiStore) jitteredInterval(interval time.Duration) time.Duration {
+	if p.cleanupJitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(p.cleanupJitter)))
+}
+
+// runCleanup runs a single cleanup pass, records its outcome in stats, and
+// reports any error to cleanupErrorHandler.
+func (p *ChaiStore) runCleanup() {
+	start := time.Now()
+	rowsDeleted, batches, err := p.deleteExpired()
+	duration := time.Since(start)
+
+	p.statsMu.Lock()
+	p.stats.RowsDeleted += rowsDeleted
+	p.stats.Batches += batches
+	p.stats.LastDuration = duration
+	p.stats.LastError = err
+	p.statsMu.Unlock()
+
+	if err != nil {
+		p.cleanupErrorHandler(err)
+	}
+}
+
+// Stats returns a snapshot of what the background cleanup goroutine has
+// done since the ChaiStore was created.
+func (p *ChaiStore) Stats() CleanupStats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	return p.stats
+}
+
 // StopCleanup terminates the background cleanup goroutine for the ChaiStore
 // instance. It's rare to terminate this; generally ChaiStore instances and
 // their cleanup goroutines are intended to be long-lived and run for the lifetime
@@ -119,6 +484,110 @@ func (p *ChaiStore) StopCleanup() {
 	}
 }
 
-func (p *ChaiStore) deleteExpired() error {
-	return p.db.Exec("DELETE FROM sessions WHERE expiry < ?", time.Now())
+// deleteExpired removes expired sessions and, since tombstones are no
+// longer needed once they're older than TombstoneTTL, GCs those too. Both
+// are removed in batches of at most cleanupBatchSize rows, pausing
+// cleanupBatchDelay between batches, so that a large backlog doesn't hold a
+// write lock long enough to stall other traffic. If cleanupMaxDuration is
+// set, the pass stops (without error) once it's been running that long,
+// leaving the remainder for the next tick.
+func (p *ChaiStore) deleteExpired() (rowsDeleted uint64, batches uint64, err error) {
+	var deadline time.Time
+	if p.cleanupMaxDuration > 0 {
+		deadline = time.Now().Add(p.cleanupMaxDuration)
+	}
+
+	now := time.Now()
+	passes := []struct {
+		table, column string
+		cutoff        time.Time
+	}{
+		{"sessions", "expiry", now},
+		{"session_tombstones", "deleted_at", now.Add(-p.tombstoneTTL)},
+	}
+
+	for _, pass := range passes {
+		for {
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				return rowsDeleted, batches, nil
+			}
+
+			n, err := p.deleteBatchWithTimeout(pass.table, pass.column, pass.cutoff)
+			if err != nil {
+				return rowsDeleted, batches, err
+			}
+			if n == 0 {
+				break
+			}
+
+			batches++
+			rowsDeleted += n
+			if n < uint64(p.cleanupBatchSize) {
+				break
+			}
+			if p.cleanupBatchDelay > 0 {
+				time.Sleep(p.cleanupBatchDelay)
+			}
+		}
+	}
+
+	return rowsDeleted, batches, nil
+}
+
+// deleteBatchWithTimeout is like deleteBatch, but derives its own opCtx
+// instead of sharing one across every batch in a deleteExpired pass, so
+// OperationTimeout bounds a single batch's query and delete, not the
+// cumulative time (including CleanupBatchDelay sleeps) of the whole pass.
+func (p *ChaiStore) deleteBatchWithTimeout(table, column string, cutoff time.Time) (uint64, error) {
+	ctx, cancel := p.opCtx(context.Background())
+	defer cancel()
+	return p.deleteBatch(p.db.WithContext(ctx), table, column, cutoff)
+}
+
+// deleteBatch removes at most cleanupBatchSize rows of table, scoped to
+// namespace, whose column is older than cutoff, and reports how many it
+// deleted.
+func (p *ChaiStore) deleteBatch(db *chai.DB, table, column string, cutoff time.Time) (uint64, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT token FROM %s WHERE namespace = ? AND %s < ? LIMIT ?", table, column), p.namespace, cutoff, p.cleanupBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var tokens []string
+	err = rows.Iterate(func(row *chai.Row) error {
+		var token string
+		if err := row.Scan(&token); err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+
+	args := make([]any, 0, len(tokens)+2)
+	args = append(args, p.namespace)
+	for _, token := range tokens {
+		args = append(args, token)
+	}
+	args = append(args, cutoff)
+
+	// A single-element "IN (?)" parses as a parenthesized scalar rather
+	// than a one-element array, so it never matches; fall back to "=".
+	// The cutoff is re-checked here, not just in the SELECT above, so a
+	// row that was renewed (e.g. Commit bumping its expiry) in the gap
+	// between the two statements doesn't get deleted anyway.
+	var query string
+	if len(tokens) == 1 {
+		query = fmt.Sprintf("DELETE FROM %s WHERE namespace = ? AND token = ? AND %s < ?", table, column)
+	} else {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(tokens)), ", ")
+		query = fmt.Sprintf("DELETE FROM %s WHERE namespace = ? AND token IN (%s) AND %s < ?", table, placeholders, column)
+	}
+	return uint64(len(tokens)), db.Exec(query, args...)
 }
@@ -2,6 +2,7 @@ package chaistore
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"reflect"
@@ -14,12 +15,28 @@ import (
 func createDBwithSessionTable(db *chai.DB) error {
 	return db.Exec(`
 		CREATE TABLE sessions (
-			token  TEXT      PRIMARY KEY,
-			data   BLOB      NOT NULL,
-			expiry TIMESTAMP NOT NULL
+			namespace TEXT      NOT NULL DEFAULT '',
+			token     TEXT      NOT NULL,
+			data      BLOB      NOT NULL,
+			expiry    TIMESTAMP NOT NULL,
+			version   INTEGER   NOT NULL DEFAULT 0,
+			PRIMARY KEY (namespace, token)
 		);
 
 		CREATE INDEX idx_sessions_expiry ON sessions(expiry);
+		CREATE INDEX idx_sessions_version ON sessions(version);
+
+		CREATE TABLE session_tombstones (
+			namespace  TEXT      NOT NULL DEFAULT '',
+			token      TEXT      NOT NULL,
+			deleted_at TIMESTAMP NOT NULL,
+			version    INTEGER   NOT NULL,
+			PRIMARY KEY (namespace, token)
+		);
+
+		CREATE INDEX idx_session_tombstones_version ON session_tombstones(version);
+
+		CREATE SEQUENCE sessions_version_seq;
 	`)
 }
 
@@ -74,6 +91,122 @@ func TestFind(t *testing.T) {
 		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
 	}
 }
+func TestCtxVariants(t *testing.T) {
+	path := "./testchai"
+
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+	ctx := context.Background()
+
+	err = p.CommitCtx(ctx, "session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, found, err := p.FindCtx(ctx, "session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != true {
+		t.Fatalf("got %v: expected %v", found, true)
+	}
+	if bytes.Equal(b, []byte("encoded_data")) == false {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+
+	err = p.DeleteCtx(ctx, "session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := db.QueryRow("SELECT COUNT(*) FROM sessions WHERE token = 'session_token'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := row.Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("got %d: expected %d", count, 0)
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0, WithOperationTimeout(time.Nanosecond))
+
+	err = p.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err == nil {
+		t.Fatal("expected an error from an already-expired operation timeout")
+	}
+}
+
+func TestCleanupErrorHandler(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan error, 1)
+	p := NewWithCleanupInterval(db, 50*time.Millisecond, WithCleanupErrorHandler(func(err error) {
+		handled <- err
+	}))
+	defer p.StopCleanup()
+
+	if err := db.Exec("DROP TABLE sessions"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-handled:
+		if err == nil {
+			t.Fatal("expected a non-nil error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("cleanup error handler was not called in time")
+	}
+}
+
 func TestFindMissing(t *testing.T) {
 	path := "./testchai"
 	if err := removeDBfile(path); err != nil {
@@ -93,7 +226,7 @@ func TestFindMissing(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = db.Exec("INSERT INTO sessions VALUES('session_token', 'ZW5jb2RlZF9kYXRh', ?)", time.Now().Add(time.Minute))
+	err = db.Exec("INSERT INTO sessions (token, data, expiry) VALUES('session_token', 'ZW5jb2RlZF9kYXRh', ?)", time.Now().Add(time.Minute))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -170,7 +303,7 @@ func TestSaveUpdated(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = db.Exec("INSERT INTO sessions VALUES('session_token', 'ZW5jb2RlZF9kYXRh', ?)", time.Now().Add(time.Minute))
+	err = db.Exec("INSERT INTO sessions (token, data, expiry) VALUES('session_token', 'ZW5jb2RlZF9kYXRh', ?)", time.Now().Add(time.Minute))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -286,6 +419,485 @@ func TestCleanup(t *testing.T) {
 	}
 }
 
+func TestDeleteWritesTombstone(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	err = p.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Delete("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := db.QueryRow("SELECT COUNT(*) FROM sessions WHERE token = 'session_token'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := row.Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("got %d: expected %d", count, 0)
+	}
+
+	row, err = db.QueryRow("SELECT COUNT(*) FROM session_tombstones WHERE token = 'session_token'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := row.Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d: expected %d tombstone row", count, 1)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0)
+
+	if err := p.Commit("token_a", []byte("a"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit("token_b", []byte("b"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, version, err := p.Changes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes: expected %d", len(changes), 2)
+	}
+	if version == 0 {
+		t.Fatal("expected a non-zero version")
+	}
+
+	if err := p.Delete("token_a"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, newVersion, err := p.Changes(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("got %d changes: expected %d", len(changes), 1)
+	}
+	if changes[0].Token != "token_a" || !changes[0].Deleted {
+		t.Fatalf("got %+v: expected a tombstone for token_a", changes[0])
+	}
+	if newVersion <= version {
+		t.Fatalf("got version %d: expected it to advance past %d", newVersion, version)
+	}
+
+	// Polling again with the latest version should report nothing new.
+	changes, _, err = p.Changes(newVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("got %d changes: expected %d", len(changes), 0)
+	}
+}
+
+func TestTombstoneCleanup(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(path)
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 200*time.Millisecond, WithTombstoneTTL(100*time.Millisecond))
+	defer p.StopCleanup()
+
+	if err := p.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Delete("session_token"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	row, err := db.QueryRow("SELECT COUNT(*) FROM session_tombstones WHERE token = 'session_token'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := row.Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("got %d: expected the tombstone to have been GC'd", count)
+	}
+}
+
+func TestCleanupBatching(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(path)
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0, WithCleanupBatchSize(2), WithCleanupBatchDelay(0))
+
+	for i := 0; i < 5; i++ {
+		token := fmt.Sprintf("token_%d", i)
+		if err := p.Commit(token, []byte("encoded_data"), time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rowsDeleted, batches, err := p.deleteExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rowsDeleted != 5 {
+		t.Fatalf("got %d rows deleted: expected %d", rowsDeleted, 5)
+	}
+	if batches != 3 {
+		t.Fatalf("got %d batches: expected %d (5 rows at a batch size of 2)", batches, 3)
+	}
+
+	row, err := db.QueryRow("SELECT COUNT(*) FROM sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := row.Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("got %d: expected all expired sessions to be gone", count)
+	}
+}
+
+func TestCleanupMaxDuration(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(path)
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0,
+		WithCleanupBatchSize(1),
+		WithCleanupBatchDelay(50*time.Millisecond),
+		WithCleanupMaxDuration(time.Nanosecond),
+	)
+
+	for i := 0; i < 3; i++ {
+		token := fmt.Sprintf("token_%d", i)
+		if err := p.Commit(token, []byte("encoded_data"), time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rowsDeleted, _, err := p.deleteExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rowsDeleted >= 3 {
+		t.Fatalf("got %d rows deleted: expected the pass to be cut short by CleanupMaxDuration", rowsDeleted)
+	}
+}
+
+func TestCleanupBatchingWithOperationTimeout(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(path)
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0,
+		WithOperationTimeout(150*time.Millisecond),
+		WithCleanupBatchSize(1),
+		WithCleanupBatchDelay(50*time.Millisecond),
+	)
+
+	for i := 0; i < 10; i++ {
+		token := fmt.Sprintf("token_%d", i)
+		if err := p.Commit(token, []byte("encoded_data"), time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// OperationTimeout should bound each batch's query/delete, not the
+	// cumulative time (including CleanupBatchDelay sleeps) of the whole
+	// pass, so all 10 expired rows should be removed without error.
+	rowsDeleted, _, err := p.deleteExpired()
+	if err != nil {
+		t.Fatalf("got error %v: expected OperationTimeout to apply per batch, not to the whole pass", err)
+	}
+	if rowsDeleted != 10 {
+		t.Fatalf("got %d rows deleted: expected %d", rowsDeleted, 10)
+	}
+}
+
+func TestStats(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer os.Remove(path)
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 50*time.Millisecond)
+	defer p.StopCleanup()
+
+	if err := p.Commit("session_token", []byte("encoded_data"), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if p.Stats().RowsDeleted > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := p.Stats()
+	if stats.RowsDeleted == 0 {
+		t.Fatal("expected the cleanup goroutine to have deleted at least one row")
+	}
+	if stats.Batches == 0 {
+		t.Fatal("expected at least one batch to have run")
+	}
+	if stats.LastError != nil {
+		t.Fatalf("got %v: expected no error", stats.LastError)
+	}
+}
+
+func TestWithCodec(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0, WithCodec(GzipCodec{}))
+
+	if err := p.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The row on disk should hold the gzipped form, not the plaintext.
+	row, err := db.QueryRow("SELECT data FROM sessions WHERE token = 'session_token'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []byte
+	if err := row.Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(stored, []byte("encoded_data")) {
+		t.Fatal("expected the stored bytes to be compressed, not plaintext")
+	}
+
+	b, found, err := p.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("expected to find the session")
+	}
+	if !bytes.Equal(b, []byte("encoded_data")) {
+		t.Fatalf("got %v: expected %v", b, []byte("encoded_data"))
+	}
+}
+
+func TestChangesWithCodec(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewWithCleanupInterval(db, 0, WithCodec(GzipCodec{}))
+
+	if err := p.Commit("session_token", []byte("encoded_data"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, _, err := p.Changes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("got %d changes: expected %d", len(changes), 1)
+	}
+	if !bytes.Equal(changes[0].Data, []byte("encoded_data")) {
+		t.Fatalf("got %v: expected the codec to have decoded the stored bytes to %v", changes[0].Data, []byte("encoded_data"))
+	}
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	path := "./testchai"
+	if err := removeDBfile(path); err != nil {
+		t.Fatal(err)
+	}
+	db, err := chai.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := createDBwithSessionTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := NewNamespacedWithCleanupInterval(db, "admin", 0)
+	public := NewNamespacedWithCleanupInterval(db, "public", 0)
+
+	if err := admin.Commit("session_token", []byte("admin_data"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := public.Commit("session_token", []byte("public_data"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, found, err := admin.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !bytes.Equal(b, []byte("admin_data")) {
+		t.Fatalf("got %v, %v: expected %v, %v", b, found, []byte("admin_data"), true)
+	}
+
+	b, found, err = public.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !bytes.Equal(b, []byte("public_data")) {
+		t.Fatalf("got %v, %v: expected %v, %v", b, found, []byte("public_data"), true)
+	}
+
+	if err := admin.Delete("session_token"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, err = admin.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("expected admin's session to be gone after Delete")
+	}
+
+	b, found, err = public.Find("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !bytes.Equal(b, []byte("public_data")) {
+		t.Fatal("expected public's session to be unaffected by admin's Delete")
+	}
+
+	all, err := public.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Fatalf("got %d sessions: expected %d", len(all), 1)
+	}
+}
+
 func TestStopNilCleanup(t *testing.T) {
 	path := "./testchai"
 	if err := removeDBfile(path); err != nil {
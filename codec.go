@@ -0,0 +1,263 @@
+package chaistore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec transforms session data before it's written to chai and after it's
+// read back, letting a ChaiStore compress or encrypt session data at rest
+// without changing the SCS-facing Commit/Find/All API. Encode runs over the
+// bytes passed to Commit before they're stored; Decode runs over the stored
+// bytes before they're returned from Find or All.
+//
+// Implementations must be safe for concurrent use, since Commit, Find, and
+// All may run concurrently from different goroutines.
+type Codec interface {
+	Encode(raw []byte) ([]byte, error)
+	Decode(stored []byte) ([]byte, error)
+}
+
+// IdentityCodec is the default Codec used by New and NewWithCleanupInterval:
+// it stores session data unmodified.
+type IdentityCodec struct{}
+
+// Encode returns raw unmodified.
+func (IdentityCodec) Encode(raw []byte) ([]byte, error) { return raw, nil }
+
+// Decode returns stored unmodified.
+func (IdentityCodec) Decode(stored []byte) ([]byte, error) { return stored, nil }
+
+// GzipCodec compresses session data with gzip. Level is the gzip
+// compression level (gzip.BestSpeed through gzip.BestCompression); the zero
+// value selects gzip.DefaultCompression.
+type GzipCodec struct {
+	Level int
+}
+
+// Encode gzip-compresses raw.
+func (c GzipCodec) Encode(raw []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode gzip-decompresses stored.
+func (c GzipCodec) Decode(stored []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// ZstdCodec compresses session data with zstd. Unlike GzipCodec, it must be
+// constructed with NewZstdCodec and closed with Close once it's no longer
+// needed, since it wraps a reusable encoder and decoder.
+type ZstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// NewZstdCodec returns a ZstdCodec ready to use as a ChaiStore Codec via
+// WithCodec.
+func NewZstdCodec() (*ZstdCodec, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return &ZstdCodec{encoder: enc, decoder: dec}, nil
+}
+
+// Encode zstd-compresses raw.
+func (c *ZstdCodec) Encode(raw []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(raw, nil), nil
+}
+
+// Decode zstd-decompresses stored.
+func (c *ZstdCodec) Decode(stored []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(stored, nil)
+}
+
+// Close releases the goroutines backing the encoder and decoder. It should
+// be called once the ChaiStore using this codec is done with it.
+func (c *ZstdCodec) Close() error {
+	c.encoder.Close()
+	c.decoder.Close()
+	return nil
+}
+
+// KeyID identifies one key in a Keyring. It's stored as a single-byte
+// prefix on every blob an AESGCMCodec produces, so a blob written under an
+// old key can still be decrypted after the active key is rotated.
+type KeyID byte
+
+// Keyring holds the AES keys an AESGCMCodec encrypts and decrypts with, and
+// supports rotating the active key without losing the ability to decrypt
+// data written under a previous one. It's safe for concurrent use.
+type Keyring struct {
+	mu     sync.RWMutex
+	active KeyID
+	aeads  map[KeyID]cipher.AEAD
+}
+
+// NewKeyring returns a Keyring whose active key is keys[active]. Every
+// value in keys must be a valid AES-128, AES-192, or AES-256 key (16, 24,
+// or 32 bytes).
+func NewKeyring(active KeyID, keys map[KeyID][]byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("chaistore: active key id %d not present in keys", active)
+	}
+
+	kr := &Keyring{active: active, aeads: make(map[KeyID]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("chaistore: key id %d: %w", id, err)
+		}
+		kr.aeads[id] = aead
+	}
+	return kr, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AddKey adds or replaces a key in the keyring without making it active.
+// Roll it out to every ChaiStore sharing the keyring, then call Rotate to
+// start encrypting new data with it.
+func (kr *Keyring) AddKey(id KeyID, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return fmt.Errorf("chaistore: key id %d: %w", id, err)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.aeads[id] = aead
+	return nil
+}
+
+// Rotate makes id, which must already have been added with AddKey, the key
+// used to encrypt new data. Blobs already encrypted under a previous key
+// keep decrypting, since each one carries its key id, until that key is
+// removed with RemoveKey.
+func (kr *Keyring) Rotate(id KeyID) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.aeads[id]; !ok {
+		return fmt.Errorf("chaistore: key id %d has not been added to the keyring", id)
+	}
+	kr.active = id
+	return nil
+}
+
+// RemoveKey drops a key from the keyring. Any session data still encrypted
+// under it becomes undecryptable, so it should only be removed once every
+// session that might have been encrypted under it has expired.
+func (kr *Keyring) RemoveKey(id KeyID) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	delete(kr.aeads, id)
+}
+
+func (kr *Keyring) currentKey() (KeyID, cipher.AEAD) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active, kr.aeads[kr.active]
+}
+
+func (kr *Keyring) key(id KeyID) (cipher.AEAD, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	aead, ok := kr.aeads[id]
+	return aead, ok
+}
+
+// AESGCMCodec encrypts session data at rest with AES-GCM, keyed from a
+// Keyring. Each blob it produces is prefixed with a one-byte key id
+// followed by the nonce, so data encrypted under an old key continues to
+// decrypt after the keyring's active key is rotated.
+type AESGCMCodec struct {
+	keyring *Keyring
+}
+
+// NewAESGCMCodec returns an AESGCMCodec that encrypts with keyring's active
+// key and decrypts with whichever key a blob's id names.
+func NewAESGCMCodec(keyring *Keyring) *AESGCMCodec {
+	return &AESGCMCodec{keyring: keyring}
+}
+
+// Encode AES-GCM encrypts raw under the keyring's active key, prefixing the
+// result with that key's id and a freshly generated nonce.
+func (c *AESGCMCodec) Encode(raw []byte) ([]byte, error) {
+	id, aead := c.keyring.currentKey()
+	if aead == nil {
+		return nil, fmt.Errorf("chaistore: keyring has no active key")
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 1+len(nonce)+len(raw)+aead.Overhead())
+	out = append(out, byte(id))
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, raw, nil), nil
+}
+
+// Decode reads the key id prefixing stored, looks up that key in the
+// keyring, and AES-GCM decrypts the remainder.
+func (c *AESGCMCodec) Decode(stored []byte) ([]byte, error) {
+	if len(stored) < 1 {
+		return nil, fmt.Errorf("chaistore: encrypted blob too short")
+	}
+
+	id := KeyID(stored[0])
+	aead, ok := c.keyring.key(id)
+	if !ok {
+		return nil, fmt.Errorf("chaistore: no key with id %d in keyring", id)
+	}
+
+	stored = stored[1:]
+	if len(stored) < aead.NonceSize() {
+		return nil, fmt.Errorf("chaistore: encrypted blob too short")
+	}
+
+	nonce, ciphertext := stored[:aead.NonceSize()], stored[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,150 @@
+package chaistore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIdentityCodec(t *testing.T) {
+	var c IdentityCodec
+
+	encoded, err := c.Encode([]byte("encoded_data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := c.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, []byte("encoded_data")) {
+		t.Fatalf("got %v: expected %v", decoded, []byte("encoded_data"))
+	}
+}
+
+func TestGzipCodec(t *testing.T) {
+	c := GzipCodec{}
+
+	raw := []byte("encoded_data")
+	encoded, err := c.Encode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(encoded, raw) {
+		t.Fatal("expected the encoded form to differ from the input")
+	}
+
+	decoded, err := c.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, raw) {
+		t.Fatalf("got %v: expected %v", decoded, raw)
+	}
+}
+
+func TestZstdCodec(t *testing.T) {
+	c, err := NewZstdCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	raw := []byte("encoded_data")
+	encoded, err := c.Encode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := c.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, raw) {
+		t.Fatalf("got %v: expected %v", decoded, raw)
+	}
+}
+
+func TestAESGCMCodec(t *testing.T) {
+	keyring, err := NewKeyring(1, map[KeyID][]byte{
+		1: bytes.Repeat([]byte{0x01}, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewAESGCMCodec(keyring)
+
+	raw := []byte("encoded_data")
+	encoded, err := c.Encode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(encoded, raw) {
+		t.Fatal("expected the encoded form to differ from the input")
+	}
+	if encoded[0] != 1 {
+		t.Fatalf("got key id %d: expected %d", encoded[0], 1)
+	}
+
+	decoded, err := c.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, raw) {
+		t.Fatalf("got %v: expected %v", decoded, raw)
+	}
+}
+
+func TestAESGCMCodecKeyRotation(t *testing.T) {
+	keyring, err := NewKeyring(1, map[KeyID][]byte{
+		1: bytes.Repeat([]byte{0x01}, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewAESGCMCodec(keyring)
+
+	raw := []byte("encoded_data")
+	oldEncoded, err := c.Encode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keyring.AddKey(2, bytes.Repeat([]byte{0x02}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Rotate(2); err != nil {
+		t.Fatal(err)
+	}
+
+	newEncoded, err := c.Encode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newEncoded[0] != 2 {
+		t.Fatalf("got key id %d: expected %d", newEncoded[0], 2)
+	}
+
+	// Data encrypted under the old key must still decrypt after rotation.
+	decoded, err := c.Decode(oldEncoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, raw) {
+		t.Fatalf("got %v: expected %v", decoded, raw)
+	}
+
+	keyring.RemoveKey(1)
+
+	if _, err := c.Decode(oldEncoded); err == nil {
+		t.Fatal("expected decoding with a removed key to fail")
+	}
+}
+
+func TestKeyringRejectsUnknownActiveKey(t *testing.T) {
+	_, err := NewKeyring(2, map[KeyID][]byte{
+		1: bytes.Repeat([]byte{0x01}, 32),
+	})
+	if err == nil {
+		t.Fatal("expected an error for an active key id missing from keys")
+	}
+}
@@ -0,0 +1,93 @@
+package chaistore
+
+import "time"
+
+// Option configures optional behavior for a ChaiStore created via New or
+// NewWithCleanupInterval.
+type Option func(*ChaiStore)
+
+// WithOperationTimeout sets a timeout applied to Find, Commit, Delete, All,
+// and the periodic cleanup query run by the background cleanup goroutine.
+// Each operation gets its own context.WithTimeout derived from the context
+// it's called with (or context.Background() for the non-Ctx methods and the
+// cleanup goroutine), so a chai transaction stuck behind a lock or disk I/O
+// is cancelled instead of blocking its caller, or the cleanup goroutine,
+// indefinitely. The zero value (the default) disables the timeout.
+func WithOperationTimeout(d time.Duration) Option {
+	return func(p *ChaiStore) {
+		p.operationTimeout = d
+	}
+}
+
+// WithCleanupErrorHandler sets the function invoked when the periodic
+// cleanup goroutine fails to delete expired sessions. It replaces the
+// default behavior of logging the error with log.Println, letting callers
+// route repeated cleanup failures to metrics, alerting, or a panic instead
+// of losing them into stderr.
+func WithCleanupErrorHandler(fn func(error)) Option {
+	return func(p *ChaiStore) {
+		p.cleanupErrorHandler = fn
+	}
+}
+
+// WithTombstoneTTL sets how long a session_tombstones row left behind by
+// Delete is kept before the background cleanup goroutine removes it. It
+// replaces the default of 72 hours. Callers tailing Changes need the
+// tombstone to still be there the next time they poll, so this should be
+// set no shorter than the longest gap expected between two such polls.
+func WithTombstoneTTL(d time.Duration) Option {
+	return func(p *ChaiStore) {
+		p.tombstoneTTL = d
+	}
+}
+
+// WithCleanupBatchSize sets the maximum number of rows the background
+// cleanup goroutine deletes from sessions or session_tombstones in a single
+// batch. It replaces the default of 500. Larger tables benefit from a
+// smaller batch size, since each batch is deleted in its own statement
+// rather than one blanket DELETE holding a write lock for the whole table.
+func WithCleanupBatchSize(n int) Option {
+	return func(p *ChaiStore) {
+		p.cleanupBatchSize = n
+	}
+}
+
+// WithCleanupBatchDelay sets how long the background cleanup goroutine
+// pauses between batches, giving other writers a chance to make progress.
+// It replaces the default of 10 milliseconds. The zero value disables the
+// pause.
+func WithCleanupBatchDelay(d time.Duration) Option {
+	return func(p *ChaiStore) {
+		p.cleanupBatchDelay = d
+	}
+}
+
+// WithCleanupMaxDuration caps how long a single cleanup pass is allowed to
+// run. Once the cap is reached, the pass stops after its current batch
+// instead of starting another, leaving the rest of the backlog for the next
+// tick. The zero value (the default) disables the cap.
+func WithCleanupMaxDuration(d time.Duration) Option {
+	return func(p *ChaiStore) {
+		p.cleanupMaxDuration = d
+	}
+}
+
+// WithCleanupJitter adds a random delay in [0, d) to every cleanup
+// interval, so that several ChaiStore instances sharing a database don't
+// all run their cleanup pass at the same moment. The zero value (the
+// default) disables jitter.
+func WithCleanupJitter(d time.Duration) Option {
+	return func(p *ChaiStore) {
+		p.cleanupJitter = d
+	}
+}
+
+// WithCodec sets the Codec used to transform session data before Commit
+// writes it and after Find or All read it back, letting callers layer
+// compression or at-rest encryption underneath the SCS-facing API. It
+// replaces the default of IdentityCodec{}, which stores data unmodified.
+func WithCodec(c Codec) Option {
+	return func(p *ChaiStore) {
+		p.codec = c
+	}
+}